@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"time"
+
+	errgo "gopkg.in/errgo.v1"
+	mgo "gopkg.in/mgo.v2"
+)
+
+type commandLineArgs struct {
+	hostname  string
+	port      string
+	ssl       bool
+	username  string
+	password  string
+	serve     string
+	interval  time.Duration
+	avgQueued bool
+
+	uri         string
+	tlsCA       string
+	tlsCert     string
+	tlsKey      string
+	tlsInsecure bool
+
+	deep         bool
+	orphanSample int
+}
+
+func commandLine() commandLineArgs {
+	flags := flag.NewFlagSet("mgopurge", flag.ExitOnError)
+	var a commandLineArgs
+	flags.StringVar(&a.hostname, "hostname", "localhost",
+		"hostname of the Juju MongoDB server")
+	flags.StringVar(&a.port, "port", "37017",
+		"port of the Juju MongoDB server")
+	flags.BoolVar(&a.ssl, "ssl", true,
+		"use SSL to connect to MonogDB ")
+	flags.StringVar(&a.username, "username", "admin",
+		"user for connecting to MonogDB (use \"\" to for no authentication)")
+	flags.StringVar(&a.password, "password", "",
+		"password for connecting to MonogDB")
+	flags.StringVar(&a.serve, "serve", "",
+		"if set, run as a daemon and serve Prometheus metrics and JSON stats on this address (e.g. :8080)")
+	flags.DurationVar(&a.interval, "interval", 30*time.Second,
+		"how often to re-scan the database when running with -serve")
+	flags.BoolVar(&a.avgQueued, "avg-queued", false,
+		"also report the mean txn-queue length per collection")
+	flags.StringVar(&a.uri, "uri", "",
+		"mongodb:// connection URI (overrides -hostname, -port, -username, -password, -ssl)")
+	flags.StringVar(&a.tlsCA, "tls-ca", "",
+		"path to a PEM CA bundle used to verify the MongoDB server certificate")
+	flags.StringVar(&a.tlsCert, "tls-cert", "",
+		"path to a PEM client certificate, e.g. for authMechanism=MONGODB-X509")
+	flags.StringVar(&a.tlsKey, "tls-key", "",
+		"path to the PEM private key matching -tls-cert")
+	flags.BoolVar(&a.tlsInsecure, "tls-insecure", false,
+		"skip verification of the MongoDB server certificate (opt-in; insecure)")
+	flags.BoolVar(&a.deep, "deep", false,
+		"fully scan every document's txn-queue when looking for orphaned tokens, instead of sampling")
+	flags.IntVar(&a.orphanSample, "orphan-sample", 1000,
+		"number of documents to sample per collection when looking for orphaned tokens; "+
+			"0 disables the check entirely (ignored with -deep)")
+
+	flags.Parse(os.Args[1:])
+
+	if a.uri == "" && a.password == "" && a.username != "" {
+		fmt.Fprintf(os.Stderr, "error: -password must be used if username is provided\n")
+		os.Exit(2)
+	}
+	return a
+}
+
+// dial connects to the MongoDB server described by args, preferring
+// -uri when set and otherwise building an equivalent connection
+// string from the legacy -hostname/-port/-username/-password/-ssl
+// flags.
+func dial(args commandLineArgs) (*mgo.Session, error) {
+	info, err := dialInfo(args)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	session, err := mgo.DialWithInfo(info)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot dial %s", info.Addrs)
+	}
+	return session, nil
+}
+
+// dialInfo builds the mgo.DialInfo used to connect to the server,
+// parsing a mongodb:// URI (replica sets, authSource,
+// authMechanism=MONGODB-X509 and friends are all expressed there) and
+// layering on TLS configuration that mgo's URI parsing does not
+// itself support.
+func dialInfo(args commandLineArgs) (*mgo.DialInfo, error) {
+	uri := args.uri
+	if uri == "" {
+		uri = legacyURI(args)
+	}
+	uri, sslRequested, err := stripSSLOption(uri)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	info, err := mgo.ParseURL(uri)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot parse mongodb connection string")
+	}
+	useTLS := sslRequested || args.tlsInsecure || args.tlsCA != "" || args.tlsCert != "" ||
+		info.Mechanism == "MONGODB-X509"
+	if useTLS {
+		tlsConfig, err := tlsConfig(args)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		info.DialServer = func(addr *mgo.ServerAddr) (net.Conn, error) {
+			return dialTLS(addr, tlsConfig)
+		}
+	}
+	return info, nil
+}
+
+// legacyURI builds a mongodb:// connection string equivalent to the
+// pre-existing -hostname/-port/-username/-password/-ssl flags, so that
+// they continue to work by going through the same URI-based dial path
+// as -uri. TLS is communicated via an "ssl" query parameter, which
+// stripSSLOption interprets and removes before the URI reaches
+// mgo.ParseURL (this vendored mgo.v2 rejects any query parameter it
+// does not itself recognise, and does not recognise "ssl").
+func legacyURI(args commandLineArgs) string {
+	u := &url.URL{
+		Scheme: "mongodb",
+		Host:   net.JoinHostPort(args.hostname, args.port),
+		Path:   "/admin",
+	}
+	if args.username != "" {
+		u.User = url.UserPassword(args.username, args.password)
+	}
+	if args.ssl {
+		u.RawQuery = "ssl=true"
+	}
+	return u.String()
+}
+
+// stripSSLOption parses uri, reports whether it carries an "ssl=true"
+// query parameter, and returns the same URI with that parameter
+// removed. mgo.ParseURL doesn't understand "ssl" and errors out on any
+// query parameter it doesn't recognise, so it must never see it; TLS
+// dialing driven by the parameter is instead wired up by the caller.
+func stripSSLOption(uri string) (string, bool, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", false, errgo.Notef(err, "cannot parse mongodb connection string")
+	}
+	query := u.Query()
+	sslRequested := query.Get("ssl") == "true"
+	query.Del("ssl")
+	u.RawQuery = query.Encode()
+	return u.String(), sslRequested, nil
+}
+
+// tlsConfig builds the *tls.Config used to dial the server, loading
+// the CA bundle and client certificate named by args if given.
+func tlsConfig(args commandLineArgs) (*tls.Config, error) {
+	config := &tls.Config{
+		InsecureSkipVerify: args.tlsInsecure,
+	}
+	if args.tlsCA != "" {
+		pem, err := ioutil.ReadFile(args.tlsCA)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot read -tls-ca")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errgo.Newf("no certificates found in -tls-ca %q", args.tlsCA)
+		}
+		config.RootCAs = pool
+	}
+	if args.tlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(args.tlsCert, args.tlsKey)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot load -tls-cert/-tls-key")
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+func dialTLS(addr *mgo.ServerAddr, tlsConfig *tls.Config) (net.Conn, error) {
+	c, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+	cc := tls.Client(c, tlsConfig)
+	if err := cc.Handshake(); err != nil {
+		return nil, err
+	}
+	return cc, nil
+}
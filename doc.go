@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"strings"
 
 	"gopkg.in/mgo.v2/bson"
 	"gopkg.in/mgo.v2/txn"
@@ -29,8 +30,22 @@ type docDoc struct {
 	Queue []string `bson:"txn-queue"`
 }
 
+// token is a txn-queue entry, as written by mgo/txn: the hex
+// ObjectId of the txn it refers to, an underscore, and a per-op
+// nonce, e.g. "54a5caa580b3b916c4000001_387fa8d1".
 type token string
 
+// id returns the ObjectId that t refers to, and whether t was well
+// formed enough to extract one.
+func (t token) id() (bson.ObjectId, bool) {
+	s := string(t)
+	i := strings.IndexByte(s, '_')
+	if i < 0 || !bson.IsObjectIdHex(s[:i]) {
+		return "", false
+	}
+	return bson.ObjectIdHex(s[:i]), true
+}
+
 type state int
 
 const (
@@ -48,6 +63,22 @@ func (s state) MarshalText() ([]byte, error) {
 	return []byte(s.String()), nil
 }
 
+// opKind classifies op, returning "insert", "update", "remove" or
+// "assert" (an assertion-only op that makes no change) depending on
+// which of its fields are set.
+func opKind(op txn.Op) string {
+	switch {
+	case op.Remove:
+		return "remove"
+	case op.Insert != nil:
+		return "insert"
+	case op.Update != nil:
+		return "update"
+	default:
+		return "assert"
+	}
+}
+
 func (s state) String() string {
 	switch s {
 	case tinvalid:
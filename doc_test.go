@@ -0,0 +1,22 @@
+package main
+
+import (
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestTokenID(t *testing.T) {
+	id := bson.NewObjectId()
+	tok := token(id.Hex() + "_387fa8d1")
+	gotID, ok := tok.id()
+	if !ok || gotID != id {
+		t.Fatalf("token.id() = (%v, %v), want (%v, true)", gotID, ok, id)
+	}
+	if _, ok := token("not-a-valid-token").id(); ok {
+		t.Fatalf("expected malformed token to fail to parse")
+	}
+	if _, ok := token("deadbeefdeadbeefdeadbeef").id(); ok {
+		t.Fatalf("expected token without a nonce separator to fail to parse")
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	collectionQueueDocsDesc = prometheus.NewDesc(
+		"txnstats_collection_queue_docs",
+		"Number of documents in the collection, including those with an empty txn-queue.",
+		[]string{"collection"}, nil,
+	)
+	collectionQueueTotalDesc = prometheus.NewDesc(
+		"txnstats_collection_queue_total",
+		"Total number of txn-queue tokens across all documents in the collection.",
+		[]string{"collection"}, nil,
+	)
+	collectionQueueMaxDesc = prometheus.NewDesc(
+		"txnstats_collection_queue_max",
+		"Largest txn-queue length seen on any single document in the collection.",
+		[]string{"collection"}, nil,
+	)
+	collectionQueueMinDesc = prometheus.NewDesc(
+		"txnstats_collection_queue_min",
+		"Smallest txn-queue length seen on any single document in the collection.",
+		[]string{"collection"}, nil,
+	)
+	collectionQueueAvgDesc = prometheus.NewDesc(
+		"txnstats_collection_queue_avg",
+		"Mean txn-queue length across all documents in the collection. Only reported when -avg-queued is set.",
+		[]string{"collection"}, nil,
+	)
+	collectionOrphanedTokensDesc = prometheus.NewDesc(
+		"txnstats_collection_orphaned_tokens",
+		"Sampled txn-queue tokens that refer to a txn that no longer exists in the txns collection.",
+		[]string{"collection"}, nil,
+	)
+	collectionPointsToAppliedDesc = prometheus.NewDesc(
+		"txnstats_collection_points_to_applied",
+		"Sampled txn-queue tokens that refer to an already-applied txn.",
+		[]string{"collection"}, nil,
+	)
+	collectionPointsToAbortedDesc = prometheus.NewDesc(
+		"txnstats_collection_points_to_aborted",
+		"Sampled txn-queue tokens that refer to an aborted txn.",
+		[]string{"collection"}, nil,
+	)
+	logDocCountDesc = prometheus.NewDesc(
+		"txnstats_log_doc_count",
+		"Number of documents in the txns.log collection.",
+		nil, nil,
+	)
+	inProgressStateDesc = prometheus.NewDesc(
+		"txnstats_inprogress_txns",
+		"Number of in-progress transactions, by state.",
+		[]string{"state"}, nil,
+	)
+	inProgressMaxOpsDesc = prometheus.NewDesc(
+		"txnstats_inprogress_max_ops",
+		"Largest number of ops seen in any single in-progress transaction.",
+		nil, nil,
+	)
+	inProgressTotalOpsDesc = prometheus.NewDesc(
+		"txnstats_inprogress_total_ops",
+		"Total number of ops across all in-progress transactions.",
+		nil, nil,
+	)
+	inProgressTotalTxnsDesc = prometheus.NewDesc(
+		"txnstats_inprogress_total_txns",
+		"Total number of in-progress transactions.",
+		nil, nil,
+	)
+	inProgressOpsHistogramDesc = prometheus.NewDesc(
+		"txnstats_inprogress_ops_histogram",
+		"Number of in-progress transactions by op-count histogram bucket.",
+		[]string{"bucket"}, nil,
+	)
+	inProgressOpKindDesc = prometheus.NewDesc(
+		"txnstats_inprogress_op_kind",
+		"Number of ops across in-progress transactions, by kind (insert, update, remove, assert).",
+		[]string{"kind"}, nil,
+	)
+	inProgressAgeHistogramDesc = prometheus.NewDesc(
+		"txnstats_inprogress_age_histogram",
+		"Number of in-progress transactions by age histogram bucket.",
+		[]string{"bucket"}, nil,
+	)
+)
+
+// statsCollector implements prometheus.Collector, exposing the most
+// recently gathered Stats as a set of metrics labelled by collection
+// name and by transaction state.
+type statsCollector struct {
+	mu    sync.Mutex
+	stats *Stats
+}
+
+// set replaces the snapshot of stats reported by the collector.
+func (sc *statsCollector) set(stats *Stats) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.stats = stats
+}
+
+// get returns the most recently set snapshot of stats, or nil if none
+// has been gathered yet.
+func (sc *statsCollector) get() *Stats {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.stats
+}
+
+// Describe implements prometheus.Collector.
+func (sc *statsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- collectionQueueDocsDesc
+	ch <- collectionQueueTotalDesc
+	ch <- collectionQueueMaxDesc
+	ch <- collectionQueueMinDesc
+	ch <- collectionQueueAvgDesc
+	ch <- collectionOrphanedTokensDesc
+	ch <- collectionPointsToAppliedDesc
+	ch <- collectionPointsToAbortedDesc
+	ch <- logDocCountDesc
+	ch <- inProgressStateDesc
+	ch <- inProgressMaxOpsDesc
+	ch <- inProgressTotalOpsDesc
+	ch <- inProgressTotalTxnsDesc
+	ch <- inProgressOpsHistogramDesc
+	ch <- inProgressOpKindDesc
+	ch <- inProgressAgeHistogramDesc
+}
+
+// Collect implements prometheus.Collector.
+func (sc *statsCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := sc.get()
+	if stats == nil {
+		return
+	}
+	for name, cs := range stats.Collections {
+		ch <- prometheus.MustNewConstMetric(collectionQueueDocsDesc, prometheus.GaugeValue, float64(cs.DocCount), name)
+		ch <- prometheus.MustNewConstMetric(collectionQueueTotalDesc, prometheus.GaugeValue, float64(cs.TotalQueued), name)
+		ch <- prometheus.MustNewConstMetric(collectionQueueMaxDesc, prometheus.GaugeValue, float64(cs.MaxQueued), name)
+		ch <- prometheus.MustNewConstMetric(collectionQueueMinDesc, prometheus.GaugeValue, float64(cs.MinQueued), name)
+		if cs.AvgQueued > 0 {
+			ch <- prometheus.MustNewConstMetric(collectionQueueAvgDesc, prometheus.GaugeValue, cs.AvgQueued, name)
+		}
+		ch <- prometheus.MustNewConstMetric(collectionOrphanedTokensDesc, prometheus.GaugeValue, float64(cs.OrphanedTokens), name)
+		ch <- prometheus.MustNewConstMetric(collectionPointsToAppliedDesc, prometheus.GaugeValue, float64(cs.PointsToApplied), name)
+		ch <- prometheus.MustNewConstMetric(collectionPointsToAbortedDesc, prometheus.GaugeValue, float64(cs.PointsToAborted), name)
+	}
+	ch <- prometheus.MustNewConstMetric(logDocCountDesc, prometheus.GaugeValue, float64(stats.Log.DocCount))
+	for s := state(0); s < numStates; s++ {
+		ch <- prometheus.MustNewConstMetric(inProgressStateDesc, prometheus.GaugeValue, float64(stats.InProgress.States[s]), s.String())
+	}
+	ch <- prometheus.MustNewConstMetric(inProgressMaxOpsDesc, prometheus.GaugeValue, float64(stats.InProgress.MaxOps))
+	ch <- prometheus.MustNewConstMetric(inProgressTotalOpsDesc, prometheus.GaugeValue, float64(stats.InProgress.TotalOps))
+	ch <- prometheus.MustNewConstMetric(inProgressTotalTxnsDesc, prometheus.GaugeValue, float64(stats.InProgress.TotalTxns))
+	for bucket, n := range stats.InProgress.OpsHistogram {
+		ch <- prometheus.MustNewConstMetric(inProgressOpsHistogramDesc, prometheus.GaugeValue, float64(n), bucket)
+	}
+	for kind, n := range stats.InProgress.OpKinds {
+		ch <- prometheus.MustNewConstMetric(inProgressOpKindDesc, prometheus.GaugeValue, float64(n), kind)
+	}
+	for bucket, n := range stats.InProgress.AgeHistogram {
+		ch <- prometheus.MustNewConstMetric(inProgressAgeHistogramDesc, prometheus.GaugeValue, float64(n), bucket)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	errgo "gopkg.in/errgo.v1"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// orphanScanBatchSize bounds how many txn-queue tokens are held in
+// memory, and looked up via a single $in query, at once. This keeps
+// -deep scans of large collections from pulling every token over the
+// wire in one go.
+const orphanScanBatchSize = 1000
+
+// orphanCounts holds the result of cross-checking a collection's
+// txn-queue tokens against the txns collection.
+type orphanCounts struct {
+	Orphaned int
+	Applied  int
+	Aborted  int
+}
+
+// getOrphanStats samples (or, with deep set, fully scans) the
+// txn-queue of documents in c, and cross-checks each token against
+// txns to find tokens that refer to a txn that no longer exists, has
+// already been applied, or was aborted. Tokens are processed in
+// fixed-size batches rather than all being held in memory at once, so
+// that -deep scans of large collections stay bounded. A non-positive
+// sampleSize (with deep unset) disables the check entirely, returning
+// zero counts without touching the database.
+func getOrphanStats(c, txns *mgo.Collection, deep bool, sampleSize int) (orphanCounts, error) {
+	if !deep && sampleSize <= 0 {
+		return orphanCounts{}, nil
+	}
+	iter := orphanScanIter(c, deep, sampleSize)
+	var counts orphanCounts
+	var doc docDoc
+	var batch []token
+	for iter.Next(&doc) {
+		for _, s := range doc.Queue {
+			batch = append(batch, token(s))
+			if len(batch) >= orphanScanBatchSize {
+				if err := countOrphanBatch(txns, batch, &counts); err != nil {
+					return orphanCounts{}, err
+				}
+				batch = batch[:0]
+			}
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return orphanCounts{}, errgo.Notef(err, "cannot scan txn-queue of collection %q", c.Name)
+	}
+	if err := countOrphanBatch(txns, batch, &counts); err != nil {
+		return orphanCounts{}, err
+	}
+	return counts, nil
+}
+
+// orphanScanIter returns the cursor used to read txn-queue tokens out
+// of c: a full scan in document order when deep is set, or a
+// server-side random sample of sampleSize documents otherwise, so
+// that repeated scans of a large collection see more than the same
+// fixed prefix every time.
+func orphanScanIter(c *mgo.Collection, deep bool, sampleSize int) *mgo.Iter {
+	hasQueue := bson.M{"txn-queue.0": bson.M{"$exists": true}}
+	if deep {
+		return c.Find(hasQueue).Select(bson.M{"txn-queue": 1}).Batch(orphanScanBatchSize).Iter()
+	}
+	return c.Pipe([]bson.M{
+		{"$match": hasQueue},
+		{"$sample": bson.M{"size": sampleSize}},
+		{"$project": bson.M{"txn-queue": 1}},
+	}).Batch(orphanScanBatchSize).Iter()
+}
+
+// countOrphanBatch looks up the txns referred to by batch and adds
+// the result to counts.
+func countOrphanBatch(txns *mgo.Collection, batch []token, counts *orphanCounts) error {
+	states, err := lookupTxnStates(txns, batch)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	for _, t := range batch {
+		id, ok := t.id()
+		if !ok {
+			counts.Orphaned++
+			continue
+		}
+		switch s, found := states[id]; {
+		case !found:
+			counts.Orphaned++
+		case s == tapplied:
+			counts.Applied++
+		case s == taborted:
+			counts.Aborted++
+		}
+	}
+	return nil
+}
+
+// lookupTxnStates looks up, in a single query, the state of every txn
+// referred to by tokens, returning a map keyed by txn id. Tokens that
+// do not parse as a valid txn id are ignored; the caller treats them
+// as orphaned.
+func lookupTxnStates(txns *mgo.Collection, tokens []token) (map[bson.ObjectId]state, error) {
+	seen := make(map[bson.ObjectId]bool)
+	var ids []bson.ObjectId
+	for _, t := range tokens {
+		if id, ok := t.id(); ok && !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	states := make(map[bson.ObjectId]state)
+	if len(ids) == 0 {
+		return states, nil
+	}
+	var tdoc struct {
+		Id    bson.ObjectId `bson:"_id"`
+		State state         `bson:"s"`
+	}
+	iter := txns.Find(bson.M{"_id": bson.M{"$in": ids}}).Select(bson.M{"s": 1}).Iter()
+	for iter.Next(&tdoc) {
+		states[tdoc.Id] = tdoc.State
+	}
+	if err := iter.Err(); err != nil {
+		return nil, errgo.Notef(err, "cannot look up txn states")
+	}
+	return states, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	errgo "gopkg.in/errgo.v1"
+	mgo "gopkg.in/mgo.v2"
+)
+
+// serve runs txnstats as a long-lived daemon: it re-scans the juju
+// database every args.interval, and exposes the resulting stats as
+// Prometheus metrics on /metrics and as a JSON snapshot on /stats.
+// It only returns if the stats collector cannot be registered, or if
+// the HTTP server fails to start or stops unexpectedly.
+func serve(session *mgo.Session, args commandLineArgs) error {
+	sc := &statsCollector{}
+	if err := refreshStats(session, args, sc); err != nil {
+		log.Printf("initial stats gathering failed: %v", err)
+	}
+	go func() {
+		ticker := time.NewTicker(args.interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := refreshStats(session, args, sc); err != nil {
+				log.Printf("cannot gather stats: %v", err)
+			}
+		}
+	}()
+
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(sc); err != nil {
+		return errgo.Notef(err, "cannot register stats collector")
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		stats := sc.get()
+		if stats == nil {
+			http.Error(w, "stats not yet available", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		data, err := json.MarshalIndent(stats, "", "\t")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(data)
+	})
+	log.Printf("serving txnstats on %s (refreshing every %s)", args.serve, args.interval)
+	return http.ListenAndServe(args.serve, mux)
+}
+
+// refreshStats gathers a fresh snapshot of stats from session and
+// installs it into sc.
+func refreshStats(session *mgo.Session, args commandLineArgs, sc *statsCollector) error {
+	stats, err := gatherStats(session, args)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	sc.set(stats)
+	return nil
+}
@@ -1,15 +1,13 @@
 package main
 
 import (
-	"crypto/tls"
 	"encoding/json"
-	"flag"
-	"fmt"
 	"log"
-	"net"
 	"os"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/juju/utils/parallel"
 	errgo "gopkg.in/errgo.v1"
@@ -24,11 +22,22 @@ type Stats struct {
 }
 
 type CollectionStats struct {
-	DocCount    int `json:",omitempty"`
-	MaxQueued   int `json:",omitempty"`
-	MinQueued   int `json:",omitempty"`
-	TotalQueued int `json:",omitempty"`
-	// TODO count bad tokens too?
+	DocCount    int     `json:",omitempty"`
+	MaxQueued   int     `json:",omitempty"`
+	MinQueued   int     `json:",omitempty"`
+	TotalQueued int     `json:",omitempty"`
+	AvgQueued   float64 `json:",omitempty"`
+
+	// OrphanedTokens, PointsToApplied and PointsToAborted count
+	// txn-queue tokens, sampled (or fully scanned with -deep), that
+	// refer to a txn that no longer exists, has already been
+	// applied, or was aborted, respectively. A healthy txn-queue
+	// entry should be pruned by mgo/txn once its txn is applied or
+	// aborted, so a non-zero count here indicates stash/queue
+	// cleanup has fallen behind.
+	OrphanedTokens  int `json:",omitempty"`
+	PointsToApplied int `json:",omitempty"`
+	PointsToAborted int `json:",omitempty"`
 }
 
 type LogStats struct {
@@ -40,6 +49,22 @@ type InProgressStats struct {
 	MaxOps    int `json:",omitempty"`
 	TotalOps  int `json:",omitempty"`
 	TotalTxns int `json:",omitempty"`
+
+	// OpsHistogram buckets in-progress txns by how many ops they
+	// contain, keyed by upper bound ("1", "2", "5", "10", "25",
+	// "100", "500", "1000+").
+	OpsHistogram map[string]int `json:",omitempty"`
+
+	// OpKinds counts ops across all in-progress txns by kind:
+	// "insert", "update", "remove" or "assert" (assert-only, no
+	// mutation).
+	OpKinds map[string]int `json:",omitempty"`
+
+	// AgeHistogram buckets in-progress txns by how long ago they
+	// were created, derived from the timestamp embedded in their
+	// ObjectId, keyed by upper bound ("<1m", "<5m", "<15m", "<1h",
+	// "<6h", "<1d", "<7d", ">=7d").
+	AgeHistogram map[string]int `json:",omitempty"`
 }
 
 func main() {
@@ -48,13 +73,38 @@ func main() {
 	if err != nil {
 		log.Fatal("cannot dial mongodb: %v", err)
 	}
+	if args.serve != "" {
+		if err := serve(session, args); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	stats, err := gatherStats(session, args)
+	if err != nil {
+		log.Fatal(err)
+	}
+	data, _ := json.MarshalIndent(stats, "", "\t")
+	os.Stdout.Write(data)
+}
+
+// gatherStats connects to the juju database on session and collects
+// a single snapshot of Stats across all collections, the txns.log
+// collection and the in-progress txns collection.
+func gatherStats(session *mgo.Session, args commandLineArgs) (*Stats, error) {
+	useAggregation := true
+	if build, err := session.BuildInfo(); err != nil {
+		return nil, errgo.Notef(err, "cannot determine server version")
+	} else {
+		useAggregation = build.VersionAtLeast(2, 6)
+	}
 	db := session.DB("juju")
 	collNames, err := db.CollectionNames()
 	if err != nil {
-		log.Fatal("cannot dial mongodb: %v", err)
+		return nil, errgo.Notef(err, "cannot list collections")
 	}
 	sort.Strings(collNames)
 	collStats := make([]CollectionStats, len(collNames))
+	txnsColl := db.C("txns")
 	run := parallel.NewRun(10)
 	for i, collName := range collNames {
 		if !wantCollectionStats(collName) {
@@ -64,10 +114,17 @@ func main() {
 		run.Do(func() error {
 			c := db.C(collName)
 
-			stats, err := getCollectionStats(c)
+			stats, err := getCollectionStats(c, useAggregation, args.avgQueued)
 			if err != nil {
 				return errgo.Notef(err, "cannot gather stats on %s: %v", c.Name, err)
 			}
+			orphans, err := getOrphanStats(c, txnsColl, args.deep, args.orphanSample)
+			if err != nil {
+				return errgo.Notef(err, "cannot gather orphan stats on %s: %v", c.Name, err)
+			}
+			stats.OrphanedTokens = orphans.Orphaned
+			stats.PointsToApplied = orphans.Applied
+			stats.PointsToAborted = orphans.Aborted
 			collStats[i] = stats
 			return nil
 		})
@@ -93,7 +150,7 @@ func main() {
 	})
 
 	if err := run.Wait(); err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	for i, collName := range collNames {
 		if !wantCollectionStats(collName) {
@@ -103,8 +160,7 @@ func main() {
 			stats.Collections[collName] = collStats[i]
 		}
 	}
-	data, _ := json.MarshalIndent(stats, "", "\t")
-	os.Stdout.Write(data)
+	return stats, nil
 }
 
 func wantCollectionStats(collName string) bool {
@@ -126,6 +182,9 @@ func getInProgressStats(c *mgo.Collection) (InProgressStats, error) {
 	var doc txnDoc
 	var stats InProgressStats
 	stats.States = make(map[state]int)
+	stats.OpsHistogram = make(map[string]int)
+	stats.OpKinds = make(map[string]int)
+	stats.AgeHistogram = make(map[string]int)
 	for iter.Next(&doc) {
 		stats.TotalTxns++
 		stats.TotalOps += len(doc.Ops)
@@ -133,6 +192,11 @@ func getInProgressStats(c *mgo.Collection) (InProgressStats, error) {
 			stats.MaxOps = len(doc.Ops)
 		}
 		stats.States[doc.State]++
+		stats.OpsHistogram[opCountBucket(len(doc.Ops))]++
+		for _, op := range doc.Ops {
+			stats.OpKinds[opKind(op)]++
+		}
+		stats.AgeHistogram[ageBucket(time.Since(doc.Id.Time()))]++
 	}
 	if err := iter.Err(); err != nil {
 		return stats, errgo.Notef(err, "iteraction over collection %q failed", c.Name)
@@ -140,10 +204,105 @@ func getInProgressStats(c *mgo.Collection) (InProgressStats, error) {
 	return stats, nil
 }
 
-func getCollectionStats(c *mgo.Collection) (CollectionStats, error) {
-	// TODO if we could rely on mongo 2.6 or later, we could use
-	// an aggregation pipeline here rather than pulling all the txn-queue
-	// elements individually.
+// opCountBucket returns the label of the op-count histogram bucket
+// that a txn with n ops falls into.
+func opCountBucket(n int) string {
+	for _, bound := range []int{1, 2, 5, 10, 25, 100, 500} {
+		if n <= bound {
+			return strconv.Itoa(bound)
+		}
+	}
+	return "1000+"
+}
+
+// ageBucket returns the label of the age histogram bucket that a txn
+// of the given age falls into.
+func ageBucket(age time.Duration) string {
+	bounds := []struct {
+		d     time.Duration
+		label string
+	}{
+		{time.Minute, "<1m"},
+		{5 * time.Minute, "<5m"},
+		{15 * time.Minute, "<15m"},
+		{time.Hour, "<1h"},
+		{6 * time.Hour, "<6h"},
+		{24 * time.Hour, "<1d"},
+		{7 * 24 * time.Hour, "<7d"},
+	}
+	for _, b := range bounds {
+		if age < b.d {
+			return b.label
+		}
+	}
+	return ">=7d"
+}
+
+// getCollectionStats gathers queue-depth statistics for c. When
+// useAggregation is true (the server supports MongoDB 2.6+ aggregation
+// pipelines) the work is done server-side in a single round trip;
+// otherwise it falls back to pulling the txn-queue of every document
+// into the client. When avgQueued is true, the returned stats also
+// include the mean queue depth.
+func getCollectionStats(c *mgo.Collection, useAggregation, avgQueued bool) (CollectionStats, error) {
+	var stats CollectionStats
+	var err error
+	if useAggregation {
+		stats, err = getCollectionStatsPipe(c)
+	} else {
+		stats, err = getCollectionStatsIter(c)
+	}
+	if err != nil {
+		return CollectionStats{}, err
+	}
+	if avgQueued && stats.DocCount > 0 {
+		stats.AvgQueued = float64(stats.TotalQueued) / float64(stats.DocCount)
+	}
+	return stats, nil
+}
+
+// getCollectionStatsPipe gathers queue-depth statistics for c using a
+// server-side aggregation pipeline, requiring MongoDB 2.6 or later.
+func getCollectionStatsPipe(c *mgo.Collection) (CollectionStats, error) {
+	var result struct {
+		DocCount    int `bson:"docCount"`
+		TotalQueued int `bson:"totalQueued"`
+		MinQueued   int `bson:"minQueued"`
+		MaxQueued   int `bson:"maxQueued"`
+	}
+	pipe := c.Pipe([]bson.M{{
+		"$project": bson.M{
+			"queueLen": bson.M{"$size": bson.M{"$ifNull": []interface{}{"$txn-queue", []interface{}{}}}},
+		},
+	}, {
+		"$group": bson.M{
+			"_id":         nil,
+			"docCount":    bson.M{"$sum": 1},
+			"totalQueued": bson.M{"$sum": "$queueLen"},
+			"minQueued":   bson.M{"$min": "$queueLen"},
+			"maxQueued":   bson.M{"$max": "$queueLen"},
+		},
+	}})
+	if err := pipe.One(&result); err != nil {
+		if err == mgo.ErrNotFound {
+			// Empty collection: $group emits no rows.
+			return CollectionStats{}, nil
+		}
+		return CollectionStats{}, errgo.Notef(err, "cannot run aggregation pipeline on %q", c.Name)
+	}
+	return CollectionStats{
+		DocCount:    result.DocCount,
+		TotalQueued: result.TotalQueued,
+		MinQueued:   result.MinQueued,
+		MaxQueued:   result.MaxQueued,
+	}, nil
+}
+
+// getCollectionStatsIter gathers queue-depth statistics for c by
+// pulling the txn-queue of every document into the client and
+// iterating over it. It is used as a fallback for servers that do not
+// support aggregation pipelines.
+func getCollectionStatsIter(c *mgo.Collection) (CollectionStats, error) {
 	iter := c.Find(nil).Batch(1000).Select(bson.M{"txn-queue": 1}).Iter()
 	var doc docDoc
 	var stats CollectionStats
@@ -168,68 +327,3 @@ func getCollectionStats(c *mgo.Collection) (CollectionStats, error) {
 	}
 	return stats, nil
 }
-
-type commandLineArgs struct {
-	hostname string
-	port     string
-	ssl      bool
-	username string
-	password string
-}
-
-func commandLine() commandLineArgs {
-	flags := flag.NewFlagSet("mgopurge", flag.ExitOnError)
-	var a commandLineArgs
-	flags.StringVar(&a.hostname, "hostname", "localhost",
-		"hostname of the Juju MongoDB server")
-	flags.StringVar(&a.port, "port", "37017",
-		"port of the Juju MongoDB server")
-	flags.BoolVar(&a.ssl, "ssl", true,
-		"use SSL to connect to MonogDB ")
-	flags.StringVar(&a.username, "username", "admin",
-		"user for connecting to MonogDB (use \"\" to for no authentication)")
-	flags.StringVar(&a.password, "password", "",
-		"password for connecting to MonogDB")
-
-	flags.Parse(os.Args[1:])
-
-	if a.password == "" && a.username != "" {
-		fmt.Fprintf(os.Stderr, "error: -password must be used if username is provided\n")
-		os.Exit(2)
-	}
-	return a
-}
-
-func dial(args commandLineArgs) (*mgo.Session, error) {
-	info := &mgo.DialInfo{
-		Addrs: []string{net.JoinHostPort(args.hostname, args.port)},
-	}
-	if args.username != "" {
-		info.Database = "admin"
-		info.Username = args.username
-		info.Password = args.password
-	}
-	if args.ssl {
-		info.DialServer = dialSSL
-	}
-	session, err := mgo.DialWithInfo(info)
-	if err != nil {
-		return nil, err
-	}
-	return session, nil
-}
-
-func dialSSL(addr *mgo.ServerAddr) (net.Conn, error) {
-	c, err := net.Dial("tcp", addr.String())
-	if err != nil {
-		return nil, err
-	}
-	tlsConfig := &tls.Config{
-		InsecureSkipVerify: true,
-	}
-	cc := tls.Client(c, tlsConfig)
-	if err := cc.Handshake(); err != nil {
-		return nil, err
-	}
-	return cc, nil
-}
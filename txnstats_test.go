@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/mgo.v2/txn"
+)
+
+func TestOpCountBucket(t *testing.T) {
+	cases := []struct {
+		n    int
+		want string
+	}{
+		{0, "1"},
+		{1, "1"},
+		{2, "2"},
+		{3, "5"},
+		{5, "5"},
+		{10, "10"},
+		{11, "25"},
+		{100, "100"},
+		{500, "500"},
+		{501, "1000+"},
+		{5000, "1000+"},
+	}
+	for _, c := range cases {
+		if got := opCountBucket(c.n); got != c.want {
+			t.Errorf("opCountBucket(%d) = %q, want %q", c.n, got, c.want)
+		}
+	}
+}
+
+func TestAgeBucket(t *testing.T) {
+	cases := []struct {
+		age  time.Duration
+		want string
+	}{
+		{0, "<1m"},
+		{30 * time.Second, "<1m"},
+		{2 * time.Minute, "<5m"},
+		{10 * time.Minute, "<15m"},
+		{20 * time.Minute, "<1h"},
+		{2 * time.Hour, "<6h"},
+		{12 * time.Hour, "<1d"},
+		{3 * 24 * time.Hour, "<7d"},
+		{10 * 24 * time.Hour, ">=7d"},
+	}
+	for _, c := range cases {
+		if got := ageBucket(c.age); got != c.want {
+			t.Errorf("ageBucket(%v) = %q, want %q", c.age, got, c.want)
+		}
+	}
+}
+
+func TestOpKind(t *testing.T) {
+	cases := []struct {
+		op   txn.Op
+		want string
+	}{
+		{txn.Op{Remove: true}, "remove"},
+		{txn.Op{Insert: bson.M{"a": 1}}, "insert"},
+		{txn.Op{Update: bson.M{"$set": bson.M{"a": 1}}}, "update"},
+		{txn.Op{Assert: bson.M{"a": 1}}, "assert"},
+	}
+	for _, c := range cases {
+		if got := opKind(c.op); got != c.want {
+			t.Errorf("opKind(%+v) = %q, want %q", c.op, got, c.want)
+		}
+	}
+}